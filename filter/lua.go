@@ -3,6 +3,8 @@ package filter
 import (
 	"fmt"
 	"runtime"
+	"sync/atomic"
+	"time"
 
 	"github.com/AdRoll/baker"
 	lua "github.com/yuin/gopher-lua"
@@ -19,6 +21,14 @@ var LUADesc = baker.FilterDesc{
 type LUAConfig struct {
 	Script     string `help:"Path to the lua script where the baker filter is defined" required:"true"`
 	FilterName string `help:"Name of the lua function to run as baker filter" required:"true"`
+
+	HTTPTimeout     time.Duration `help:"Timeout of requests issued through the http lua module" default:"10s"`
+	HTTPMaxBodySize int64         `help:"Max size in bytes of a response body read by the http lua module" default:"1048576"`
+	HTTPAllowHosts  []string      `help:"If not empty, restricts the http lua module to only contact these hosts"`
+
+	Version string `help:"Lua language version implemented by the script, \"5.1\" (LUA filter) or \"5.4\" (LUA54 filter)" default:"5.1"`
+
+	OnError string `help:"What to do with a record when the lua filter call fails: \"panic\" (abort the topology), \"drop\" (discard the record) or \"passthrough\" (forward the record unmodified)" default:"panic"`
 }
 
 type LUA struct {
@@ -27,17 +37,30 @@ type LUA struct {
 	luaFunc lua.LValue     // lua filter function
 	luaNext *lua.LFunction // lua next function (reused)
 	next    func(baker.Record)
+
+	onError luaOnError
+	metrics baker.MetricsClient
+	errors  int64 // total number of failed Process calls, see Stats()
 }
 
 func NewLUA(cfg baker.FilterParams) (baker.Filter, error) {
 	dcfg := cfg.DecodedConfig.(*LUAConfig)
 
+	if v := dcfg.Version; v != "" && v != "5.1" {
+		return nil, fmt.Errorf("LUA filter requires Version=\"5.1\", got %q (use LUA54 for lua 5.4 scripts)", v)
+	}
+
+	onError, err := parseLUAOnError(dcfg.OnError)
+	if err != nil {
+		return nil, err
+	}
+
 	l := lua.NewState()
 	if err := l.DoFile(dcfg.Script); err != nil {
 		return nil, fmt.Errorf("can't compile lua script %q: %v", dcfg.Script, err)
 	}
 
-	registerLUATypes(l, cfg.ComponentParams)
+	registerLUATypes(l, cfg.ComponentParams, dcfg)
 
 	luaFunc := l.GetGlobal(dcfg.FilterName)
 	if luaFunc.Type() == lua.LTNil {
@@ -63,14 +86,19 @@ func NewLUA(cfg baker.FilterParams) (baker.Filter, error) {
 	f.ud = ud
 	f.luaNext = luaNext
 	f.luaFunc = luaFunc
+	f.onError = onError
+	f.metrics = cfg.ComponentParams.Metrics
 
 	runtime.SetFinalizer(f, func(f *LUA) { f.l.Close() })
 
 	return f, nil
 }
 
-func registerLUATypes(l *lua.LState, comp baker.ComponentParams) {
+func registerLUATypes(l *lua.LState, comp baker.ComponentParams, cfg *LUAConfig) {
 	registerLUARecordType(l)
+	registerLUAHTTPType(l, newLUAHTTPClient(cfg))
+	registerLUAJSONType(l)
+	registerLUABakerType(l)
 
 	l.SetGlobal("createRecord", l.NewFunction(func(L *lua.LState) int {
 		rec := comp.CreateRecord()
@@ -95,9 +123,21 @@ func registerLUATypes(l *lua.LState, comp baker.ComponentParams) {
 	l.SetGlobal("fieldNames", fields)
 }
 
-func (t *LUA) Stats() baker.FilterStats { return baker.FilterStats{} }
+// Stats reports the total number of failed Process calls. baker.FilterStats
+// has no field for a per-reason breakdown: that's only available via the
+// "lua.filter.errors" metric, tagged with "reason:<reason>".
+func (t *LUA) Stats() baker.FilterStats {
+	return baker.FilterStats{Errors: atomic.LoadInt64(&t.errors)}
+}
 
 func (t *LUA) Process(rec baker.Record, next func(baker.Record)) {
+	// Passthrough must forward the record as it was before the script ran,
+	// not whatever record:set left behind, so snapshot it upfront.
+	var orig baker.Record
+	if t.onError == luaOnErrorPassthrough {
+		orig = rec.Copy()
+	}
+
 	// Modify the record inside the pre-allocated user value
 	t.ud.Value = &luaRecord{r: rec}
 
@@ -111,7 +151,21 @@ func (t *LUA) Process(rec baker.Record, next func(baker.Record)) {
 		Protect: true,
 	}, t.ud, t.luaNext)
 
-	if err != nil {
+	if err == nil {
+		return
+	}
+
+	atomic.AddInt64(&t.errors, 1)
+	if t.metrics != nil {
+		t.metrics.BumpSumWithTags("lua.filter.errors", 1, []string{"reason:" + luaErrorReason(err)})
+	}
+
+	switch t.onError {
+	case luaOnErrorDrop:
+		return
+	case luaOnErrorPassthrough:
+		next(orig)
+	default:
 		panic(err)
 	}
 }
@@ -147,10 +201,12 @@ func fastcheckLuaRecord(L *lua.LState, n int) *luaRecord {
 }
 
 var luaRecordMethods = map[string]lua.LGFunction{
-	"get":   luaRecordGet,
-	"set":   luaRecordSet,
-	"copy":  luaRecordCopy,
-	"clear": luaRecordClear,
+	"get":     luaRecordGet,
+	"set":     luaRecordSet,
+	"copy":    luaRecordCopy,
+	"clear":   luaRecordClear,
+	"getJSON": luaRecordGetJSON,
+	"setJSON": luaRecordSetJSON,
 }
 
 type luaRecord struct {
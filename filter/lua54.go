@@ -0,0 +1,315 @@
+package filter
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+	golib "github.com/arnodel/golua/lib"
+	grt "github.com/arnodel/golua/runtime"
+)
+
+// LUA54Desc describes the LUA54 filter.
+var LUA54Desc = baker.FilterDesc{
+	Name:   "LUA54",
+	New:    NewLUA54,
+	Config: &LUAConfig{},
+	Help: `Run a baker filter defined in a lua script, using a Lua 5.4 compatible
+runtime (integer subtype, bitwise operators, goto and the other 5.4
+additions needed to run scripts written for modern Lua).
+
+Unlike LUA, which keeps a single gopher-lua state and relies on Process
+being called serially, LUA54 keeps a pool of pre-compiled runtimes, one
+per concurrent worker, so a single filter instance can run scripts on
+more than one core at a time.
+
+Supports the same OnError/baker.drop/baker.log contract as LUA, and the
+same record:getJSON/setJSON helpers, but not (yet) the bare http/json
+global modules, which remain LUA-only.`,
+}
+
+// lua54State wraps everything a single worker needs to run the compiled
+// script: the golua runtime, the reused record wrapper and next function,
+// and the compiled filter function. Exactly one goroutine owns
+// a given lua54State at a time; ownership is managed by lua54StatePool.
+type lua54State struct {
+	rt      *grt.Runtime
+	luaFunc grt.Value
+	ud      *luaRecord // reused across Process calls, see LUA54.Process
+	next    func(baker.Record)
+}
+
+// lua54StatePool hands out a fixed number of pre-warmed lua54State
+// values, one per concurrent worker. States are never created on
+// demand past the initial fill: Process blocks until one is returned,
+// which bounds the number of lua runtimes (and thus scripts running
+// concurrently) to poolSize.
+type lua54StatePool struct {
+	free chan *lua54State
+}
+
+func newLua54StatePool(poolSize int, newState func() (*lua54State, error)) (*lua54StatePool, error) {
+	p := &lua54StatePool{free: make(chan *lua54State, poolSize)}
+	for i := 0; i < poolSize; i++ {
+		st, err := newState()
+		if err != nil {
+			return nil, fmt.Errorf("can't initialize lua 5.4 state pool: %v", err)
+		}
+		p.free <- st
+	}
+	return p, nil
+}
+
+func (p *lua54StatePool) get() *lua54State   { return <-p.free }
+func (p *lua54StatePool) put(st *lua54State) { p.free <- st }
+
+// LUA54 is a baker filter running a lua script on a Lua 5.4 compatible
+// runtime. Differently from LUA, Process can be called concurrently:
+// each call checks out a lua54State from the pool for the duration of
+// the call and returns it once done.
+type LUA54 struct {
+	pool       *lua54StatePool
+	script     []byte
+	scriptName string
+	filterName string
+
+	onError luaOnError
+	metrics baker.MetricsClient
+	errors  int64 // total number of failed Process calls, see Stats()
+}
+
+// NewLUA54 creates a LUA54 filter, pre-compiling and running the script
+// once per worker (one per GOMAXPROCS) to populate the state pool.
+func NewLUA54(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*LUAConfig)
+
+	if v := dcfg.Version; v != "" && v != "5.4" {
+		return nil, fmt.Errorf("LUA54 filter requires Version=\"5.4\", got %q", v)
+	}
+
+	onError, err := parseLUAOnError(dcfg.OnError)
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := readLuaScript(dcfg.Script)
+	if err != nil {
+		return nil, fmt.Errorf("can't read lua script %q: %v", dcfg.Script, err)
+	}
+
+	f := &LUA54{
+		script:     script,
+		scriptName: dcfg.Script,
+		filterName: dcfg.FilterName,
+		onError:    onError,
+		metrics:    cfg.ComponentParams.Metrics,
+	}
+
+	poolSize := runtime.GOMAXPROCS(0)
+	pool, err := newLua54StatePool(poolSize, func() (*lua54State, error) {
+		return newLua54State(f.scriptName, f.script, f.filterName, cfg.ComponentParams)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.pool = pool
+
+	return f, nil
+}
+
+func readLuaScript(path string) ([]byte, error) {
+	return grt.ReadSourceFile(path)
+}
+
+// newLua54State compiles the script and runs it to completion in a
+// fresh runtime (picking up global function/table definitions, exactly
+// like lua.DoFile does for LUA), then resolves filterName as the
+// function the worker will call from Process.
+func newLua54State(scriptName string, script []byte, filterName string, comp baker.ComponentParams) (*lua54State, error) {
+	rt := grt.New(nil)
+	golib.LoadAll(rt)
+
+	registerLUA54Types(rt, comp)
+
+	closure, err := grt.CompileAndLoadLuaChunk(scriptName, script, rt.GlobalEnv())
+	if err != nil {
+		return nil, fmt.Errorf("can't compile lua script %q: %v", scriptName, err)
+	}
+	if _, err := grt.Call1(rt.MainThread(), grt.FunctionValue(closure)); err != nil {
+		return nil, fmt.Errorf("can't run lua script %q: %v", scriptName, err)
+	}
+
+	luaFunc, ok := rt.GlobalEnv().Get(grt.StringValue(filterName))
+	if !ok || luaFunc == grt.NilValue {
+		return nil, fmt.Errorf("can't find lua filter %q in script %q", filterName, scriptName)
+	}
+
+	st := &lua54State{rt: rt, luaFunc: luaFunc, ud: &luaRecord{}}
+	return st, nil
+}
+
+// registerLUA54Types exposes createRecord/validateRecord/fieldNames and
+// the baker module to the script, the Lua 5.4 equivalent of
+// registerLUATypes.
+func registerLUA54Types(rt *grt.Runtime, comp baker.ComponentParams) {
+	env := rt.GlobalEnv()
+
+	registerLUA54BakerType(rt)
+
+	env.Set(grt.StringValue("createRecord"), grt.GoFunctionFunc(func(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+		rec := comp.CreateRecord()
+		return grt.Cont(c.PushingNext1(t.Runtime, recordToLua54(&luaRecord{r: rec}))), nil
+	}, "createRecord", 0, false))
+
+	env.Set(grt.StringValue("validateRecord"), grt.GoFunctionFunc(func(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+		luar := checkLua54Record(c, 0)
+		ok, fidx := comp.ValidateRecord(luar.r)
+		return grt.Cont(c.PushingNext(t.Runtime, grt.BoolValue(ok), grt.IntValue(int64(fidx)))), nil
+	}, "validateRecord", 1, false))
+
+	fields := grt.NewTable()
+	for i, n := range comp.FieldNames {
+		fields.Set(grt.StringValue(n), grt.IntValue(int64(i)))
+	}
+	env.Set(grt.StringValue("fieldNames"), grt.TableValue(fields))
+}
+
+// lua54RecordMeta is the metatable shared by every lua54 record
+// userdata: an __index table mirroring luaRecordMethods (see lua.go),
+// adapted to the golua GoFunctionFunc signature. It's built once since
+// it doesn't depend on any particular runtime or record instance.
+var lua54RecordMeta = newLua54RecordMetatable()
+
+func newLua54RecordMetatable() *grt.Table {
+	idx := grt.NewTable()
+	idx.Set(grt.StringValue("get"), grt.GoFunctionValue(grt.GoFunctionFunc(lua54RecordGet, "get", 2, false)))
+	idx.Set(grt.StringValue("set"), grt.GoFunctionValue(grt.GoFunctionFunc(lua54RecordSet, "set", 3, false)))
+	idx.Set(grt.StringValue("copy"), grt.GoFunctionValue(grt.GoFunctionFunc(lua54RecordCopy, "copy", 1, false)))
+	idx.Set(grt.StringValue("clear"), grt.GoFunctionValue(grt.GoFunctionFunc(lua54RecordClear, "clear", 1, false)))
+	idx.Set(grt.StringValue("getJSON"), grt.GoFunctionValue(grt.GoFunctionFunc(lua54RecordGetJSON, "getJSON", 2, false)))
+	idx.Set(grt.StringValue("setJSON"), grt.GoFunctionValue(grt.GoFunctionFunc(lua54RecordSetJSON, "setJSON", 3, false)))
+
+	meta := grt.NewTable()
+	meta.Set(grt.StringValue("__index"), grt.TableValue(idx))
+	return meta
+}
+
+func recordToLua54(luar *luaRecord) grt.Value {
+	ud := grt.NewUserData(luar, lua54RecordMeta)
+	return grt.UserDataValue(ud)
+}
+
+func checkLua54Record(c *grt.GoCont, n int) *luaRecord {
+	ud := c.Arg(n).AsUserData()
+	return ud.Data().(*luaRecord)
+}
+
+// record:get(int) returns string
+func lua54RecordGet(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+	luar := checkLua54Record(c, 0)
+	fidx := c.Arg(1).AsInt()
+
+	buf := luar.r.Get(baker.FieldIndex(fidx))
+	return grt.Cont(c.PushingNext1(t.Runtime, grt.StringValue(string(buf)))), nil
+}
+
+// record:set(int, string)
+func lua54RecordSet(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+	luar := checkLua54Record(c, 0)
+	fidx := c.Arg(1).AsInt()
+	val := c.Arg(2).AsString()
+
+	luar.r.Set(baker.FieldIndex(fidx), []byte(val))
+	return grt.Cont(c.Next()), nil
+}
+
+// record:copy() record
+func lua54RecordCopy(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+	luar := checkLua54Record(c, 0)
+	cpy := luar.r.Copy()
+	return grt.Cont(c.PushingNext1(t.Runtime, recordToLua54(&luaRecord{r: cpy}))), nil
+}
+
+// record:clear()
+func lua54RecordClear(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+	luar := checkLua54Record(c, 0)
+	luar.r.Clear()
+	return grt.Cont(c.Next()), nil
+}
+
+// Stats reports the total number of failed Process calls. As with LUA,
+// baker.FilterStats has no field for a per-reason breakdown: that's only
+// available via the "lua.filter.errors" metric, tagged with
+// "reason:<reason>".
+func (t *LUA54) Stats() baker.FilterStats {
+	return baker.FilterStats{Errors: atomic.LoadInt64(&t.errors)}
+}
+
+// Process checks out a state from the pool, runs the script against it
+// and returns the state once done, so it can be reused by whichever
+// goroutine calls Process next.
+func (t *LUA54) Process(rec baker.Record, next func(baker.Record)) {
+	st := t.pool.get()
+	defer t.pool.put(st)
+
+	// Passthrough must forward the record as it was before the script ran,
+	// not whatever record:set left behind, so snapshot it upfront.
+	var orig baker.Record
+	if t.onError == luaOnErrorPassthrough {
+		orig = rec.Copy()
+	}
+
+	st.ud.r = rec
+	st.next = next
+
+	th := st.rt.MainThread()
+	nextFn := grt.GoFunctionFunc(func(rt *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+		luar := checkLua54Record(c, 0)
+		st.next(luar.r)
+		return grt.Cont(c.Next()), nil
+	}, "next", 1, false)
+
+	_, err := grt.Call(th, st.luaFunc, []grt.Value{recordToLua54(st.ud), grt.GoFunctionValue(nextFn)})
+	if err == nil {
+		return
+	}
+
+	atomic.AddInt64(&t.errors, 1)
+	if t.metrics != nil {
+		t.metrics.BumpSumWithTags("lua.filter.errors", 1, []string{"reason:" + luaErrorReason(err)})
+	}
+
+	switch t.onError {
+	case luaOnErrorDrop:
+		return
+	case luaOnErrorPassthrough:
+		next(orig)
+	default:
+		panic(err)
+	}
+}
+
+// registerLUA54BakerType registers the `baker` global table (drop/log)
+// exposed to golua scripts, the Lua 5.4 equivalent of
+// registerLUABakerType.
+func registerLUA54BakerType(rt *grt.Runtime) {
+	mod := grt.NewTable()
+
+	mod.Set(grt.StringValue("drop"), grt.GoFunctionValue(grt.GoFunctionFunc(func(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+		reason := ""
+		if c.NArgs() > 0 {
+			reason = c.Arg(0).AsString()
+		}
+		return nil, fmt.Errorf("%s%s", luaDropErrPrefix, reason)
+	}, "drop", 0, true)))
+
+	mod.Set(grt.StringValue("log"), grt.GoFunctionValue(grt.GoFunctionFunc(func(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+		level := c.Arg(0).AsString()
+		msg := c.Arg(1).AsString()
+		luaLogger.Printf("[lua][%s] %s", level, msg)
+		return grt.Cont(c.Next()), nil
+	}, "log", 2, false)))
+
+	rt.GlobalEnv().Set(grt.StringValue("baker"), grt.TableValue(mod))
+}
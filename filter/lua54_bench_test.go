@@ -0,0 +1,60 @@
+package filter
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+// benchComponentParams drives the LUA/LUA54 benchmarks below with a real
+// baker.LogLine rather than a hand-rolled stand-in, since baker.Record
+// has more methods (ToText, Parse, Cache, Hash...) than the script
+// under test happens to touch.
+func benchComponentParams() baker.ComponentParams {
+	return baker.ComponentParams{
+		CreateRecord: func() baker.Record { return &baker.LogLine{} },
+		FieldNames:   []string{"value"},
+	}
+}
+
+func benchmarkLuaFilter(b *testing.B, filter baker.Filter) {
+	rec := &baker.LogLine{}
+	rec.Set(0, []byte(strconv.Itoa(42)))
+	next := func(baker.Record) {}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Process(rec, next)
+	}
+}
+
+// BenchmarkLUA exercises the gopher-lua (5.1) backed filter.
+func BenchmarkLUA(b *testing.B) {
+	cfg := benchComponentParams()
+	cfg.DecodedConfig = &LUAConfig{
+		Script:     "testdata/bench.lua",
+		FilterName: "Filter",
+	}
+	f, err := NewLUA(baker.FilterParams{ComponentParams: cfg})
+	if err != nil {
+		b.Fatalf("can't create LUA filter: %v", err)
+	}
+	benchmarkLuaFilter(b, f)
+}
+
+// BenchmarkLUA54 exercises the golua (5.4) backed filter, running with
+// GOMAXPROCS(0) pooled states like it would in production.
+func BenchmarkLUA54(b *testing.B) {
+	cfg := benchComponentParams()
+	cfg.DecodedConfig = &LUAConfig{
+		Script:     "testdata/bench.lua",
+		FilterName: "Filter",
+		Version:    "5.4",
+	}
+	f, err := NewLUA54(baker.FilterParams{ComponentParams: cfg})
+	if err != nil {
+		b.Fatalf("can't create LUA54 filter: %v", err)
+	}
+	benchmarkLuaFilter(b, f)
+}
@@ -0,0 +1,164 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/AdRoll/baker"
+	grt "github.com/arnodel/golua/runtime"
+)
+
+// record:getJSON(fidx) table
+func lua54RecordGetJSON(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+	luar := checkLua54Record(c, 0)
+	fidx := c.Arg(1).AsInt()
+
+	buf := luar.r.Get(baker.FieldIndex(fidx))
+
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, fmt.Errorf("getJSON: %v", err)
+	}
+	val, err := jsonToGolua54Value(v, 0)
+	if err != nil {
+		return nil, fmt.Errorf("getJSON: %v", err)
+	}
+	return grt.Cont(c.PushingNext1(t.Runtime, val)), nil
+}
+
+// record:setJSON(fidx, table)
+func lua54RecordSetJSON(t *grt.Thread, c *grt.GoCont) (grt.Cont, error) {
+	luar := checkLua54Record(c, 0)
+	fidx := c.Arg(1).AsInt()
+
+	v, err := golua54ValueToJSON(c.Arg(2), 0)
+	if err != nil {
+		return nil, fmt.Errorf("setJSON: %v", err)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("setJSON: %v", err)
+	}
+
+	luar.r.Set(baker.FieldIndex(fidx), buf)
+	return grt.Cont(c.Next()), nil
+}
+
+// golua54ValueToJSON is the golua equivalent of luaValueToJSON (see
+// lua_json.go): same array-vs-object and depth-bound rules, adapted to
+// grt.Value/grt.Table.
+func golua54ValueToJSON(v grt.Value, depth int) (interface{}, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("exceeded max encoding depth of %d", maxJSONDepth)
+	}
+
+	if v == grt.NilValue {
+		return nil, nil
+	}
+
+	switch v.Type() {
+	case grt.BoolType:
+		return v.AsBool(), nil
+	case grt.IntType:
+		return float64(v.AsInt()), nil
+	case grt.FloatType:
+		return v.AsFloat(), nil
+	case grt.StringType:
+		return v.AsString(), nil
+	case grt.TableType:
+		tbl := v.AsTable()
+		n := tbl.Len()
+		count := 0
+		for k := grt.NilValue; ; {
+			nk, _, ok := tbl.Next(k)
+			if !ok || nk == grt.NilValue {
+				break
+			}
+			count++
+			k = nk
+		}
+		if n > 0 && count == n {
+			arr := make([]interface{}, n)
+			for i := 1; i <= n; i++ {
+				elem, ok := tbl.Get(grt.IntValue(int64(i)))
+				if !ok {
+					return nil, fmt.Errorf("cannot encode sparse table as json array")
+				}
+				ev, err := golua54ValueToJSON(elem, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr[i-1] = ev
+			}
+			return arr, nil
+		}
+
+		obj := make(map[string]interface{})
+		for k := grt.NilValue; ; {
+			nk, nv, ok := tbl.Next(k)
+			if !ok {
+				break
+			}
+			ev, err := golua54ValueToJSON(nv, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			obj[golua54KeyString(nk)] = ev
+			k = nk
+		}
+		return obj, nil
+	default:
+		return nil, fmt.Errorf("cannot encode lua type %v as json", v.Type())
+	}
+}
+
+// golua54KeyString renders a table key as a JSON object key, the golua
+// equivalent of LValue.String() used by luaValueToJSON.
+func golua54KeyString(k grt.Value) string {
+	if k.Type() == grt.StringType {
+		return k.AsString()
+	}
+	return fmt.Sprint(k)
+}
+
+// jsonToGolua54Value is the golua equivalent of jsonToLuaValue (see
+// lua_json.go): like it, it reports (rather than silently truncates)
+// a document nested past maxJSONDepth.
+func jsonToGolua54Value(v interface{}, depth int) (grt.Value, error) {
+	if depth > maxJSONDepth {
+		return grt.NilValue, fmt.Errorf("exceeded max decoding depth of %d", maxJSONDepth)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return grt.NilValue, nil
+	case bool:
+		return grt.BoolValue(v), nil
+	case float64:
+		return grt.FloatValue(v), nil
+	case string:
+		return grt.StringValue(v), nil
+	case []interface{}:
+		t := grt.NewTable()
+		for i, elem := range v {
+			ev, err := jsonToGolua54Value(elem, depth+1)
+			if err != nil {
+				return grt.NilValue, err
+			}
+			t.Set(grt.IntValue(int64(i+1)), ev)
+		}
+		return grt.TableValue(t), nil
+	case map[string]interface{}:
+		t := grt.NewTable()
+		for k, elem := range v {
+			ev, err := jsonToGolua54Value(elem, depth+1)
+			if err != nil {
+				return grt.NilValue, err
+			}
+			t.Set(grt.StringValue(k), ev)
+		}
+		return grt.TableValue(t), nil
+	default:
+		return grt.NilValue, fmt.Errorf("cannot decode json value of type %T", v)
+	}
+}
@@ -0,0 +1,77 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaOnError selects what a LUA filter does with a record when the
+// script fails to process it (lua runtime error, or an explicit
+// baker.drop(reason) call).
+type luaOnError int
+
+const (
+	luaOnErrorPanic luaOnError = iota
+	luaOnErrorDrop
+	luaOnErrorPassthrough
+)
+
+func parseLUAOnError(s string) (luaOnError, error) {
+	switch s {
+	case "", "panic":
+		return luaOnErrorPanic, nil
+	case "drop":
+		return luaOnErrorDrop, nil
+	case "passthrough":
+		return luaOnErrorPassthrough, nil
+	default:
+		return 0, fmt.Errorf("invalid OnError %q: must be one of \"panic\", \"drop\", \"passthrough\"", s)
+	}
+}
+
+// luaDropErrPrefix tags the lua runtime error raised by baker.drop(reason),
+// so that luaErrorReason can recover the reason a script gave for dropping
+// a record, as opposed to a generic lua runtime error.
+const luaDropErrPrefix = "\x00baker.drop:"
+
+// luaErrorReason extracts a short, metric-tag-friendly reason from a
+// failed Process call: the reason passed to baker.drop, if any, or
+// "error" for any other lua runtime error.
+func luaErrorReason(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, luaDropErrPrefix); i >= 0 {
+		if reason := strings.TrimSpace(msg[i+len(luaDropErrPrefix):]); reason != "" {
+			return reason
+		}
+		return "dropped"
+	}
+	return "error"
+}
+
+// luaLogger is where baker.log(level, msg) calls are forwarded to.
+var luaLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+// registerLUABakerType registers the `baker` global table (drop/log)
+// used by scripts to surface structured errors and log messages.
+func registerLUABakerType(L *lua.LState) {
+	mod := L.NewTable()
+
+	mod.RawSetString("drop", L.NewFunction(func(L *lua.LState) int {
+		reason := L.OptString(1, "")
+		L.RaiseError("%s%s", luaDropErrPrefix, reason)
+		return 0
+	}))
+
+	mod.RawSetString("log", L.NewFunction(func(L *lua.LState) int {
+		level := L.CheckString(1)
+		msg := L.CheckString(2)
+		luaLogger.Printf("[lua][%s] %s", level, msg)
+		return 0
+	}))
+
+	L.SetGlobal("baker", mod)
+}
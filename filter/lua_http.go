@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaHTTPClient is the sandboxed HTTP client exposed to lua scripts as the
+// global `http` module. It is built once per LUA filter instance from
+// LUAConfig, so every request a script issues shares the same timeout,
+// max response size and host allow-list.
+type luaHTTPClient struct {
+	client      *http.Client
+	maxBodySize int64
+	allowHosts  map[string]bool
+}
+
+func newLUAHTTPClient(cfg *LUAConfig) *luaHTTPClient {
+	var allow map[string]bool
+	if len(cfg.HTTPAllowHosts) > 0 {
+		allow = make(map[string]bool, len(cfg.HTTPAllowHosts))
+		for _, h := range cfg.HTTPAllowHosts {
+			allow[h] = true
+		}
+	}
+
+	return &luaHTTPClient{
+		client:      &http.Client{Timeout: cfg.HTTPTimeout},
+		maxBodySize: cfg.HTTPMaxBodySize,
+		allowHosts:  allow,
+	}
+}
+
+// checkHost rejects requests to hosts outside of the configured allow-list,
+// when one is set.
+func (c *luaHTTPClient) checkHost(rawurl string) error {
+	if c.allowHosts == nil {
+		return nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %v", rawurl, err)
+	}
+	if !c.allowHosts[u.Hostname()] {
+		return fmt.Errorf("host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// do runs method/reqURL synchronously (blocking the calling goroutine, and
+// thus the lua state, until the response has been read) and pushes
+// (body, status, err) on the lua stack.
+func (c *luaHTTPClient) do(L *lua.LState, method, reqURL string, headers *lua.LTable, body string) int {
+	push := func(respBody string, status int, err error) int {
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LNumber(status))
+			L.Push(lua.LString(err.Error()))
+			return 3
+		}
+		L.Push(lua.LString(respBody))
+		L.Push(lua.LNumber(status))
+		L.Push(lua.LNil)
+		return 3
+	}
+
+	if err := c.checkHost(reqURL); err != nil {
+		return push("", 0, err)
+	}
+
+	var rdr io.Reader
+	if body != "" {
+		rdr = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, reqURL, rdr)
+	if err != nil {
+		return push("", 0, err)
+	}
+	if headers != nil {
+		headers.ForEach(func(k, v lua.LValue) {
+			req.Header.Set(k.String(), v.String())
+		})
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return push("", 0, err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxBodySize))
+	if err != nil {
+		return push("", resp.StatusCode, err)
+	}
+
+	return push(string(buf), resp.StatusCode, nil)
+}
+
+func optLuaHeaders(L *lua.LState, n int) *lua.LTable {
+	if t, ok := L.Get(n).(*lua.LTable); ok {
+		return t
+	}
+	return nil
+}
+
+// registerLUAHTTPType registers the `http` global table (get/post/put/
+// delete/request) backed by client.
+func registerLUAHTTPType(L *lua.LState, client *luaHTTPClient) {
+	mod := L.NewTable()
+
+	mod.RawSetString("get", L.NewFunction(func(L *lua.LState) int {
+		return client.do(L, http.MethodGet, L.CheckString(1), optLuaHeaders(L, 2), "")
+	}))
+
+	mod.RawSetString("post", L.NewFunction(func(L *lua.LState) int {
+		return client.do(L, http.MethodPost, L.CheckString(1), optLuaHeaders(L, 3), L.OptString(2, ""))
+	}))
+
+	mod.RawSetString("put", L.NewFunction(func(L *lua.LState) int {
+		return client.do(L, http.MethodPut, L.CheckString(1), optLuaHeaders(L, 3), L.OptString(2, ""))
+	}))
+
+	mod.RawSetString("delete", L.NewFunction(func(L *lua.LState) int {
+		return client.do(L, http.MethodDelete, L.CheckString(1), optLuaHeaders(L, 2), "")
+	}))
+
+	mod.RawSetString("request", L.NewFunction(func(L *lua.LState) int {
+		method := strings.ToUpper(L.CheckString(1))
+		return client.do(L, method, L.CheckString(2), optLuaHeaders(L, 4), L.OptString(3, ""))
+	}))
+
+	L.SetGlobal("http", mod)
+}
@@ -0,0 +1,201 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/AdRoll/baker"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxJSONDepth bounds how deeply nested a lua table (when encoding) or a
+// JSON document (when decoding) can be, so that a malicious or buggy
+// script/record can't crash the worker with a stack overflow.
+const maxJSONDepth = 100
+
+// registerLUAJSONType registers the `json` global table (encode/decode)
+// used by scripts. record:getJSON/record:setJSON below share its
+// conversion helpers rather than calling this table.
+func registerLUAJSONType(L *lua.LState) {
+	mod := L.NewTable()
+
+	mod.RawSetString("encode", L.NewFunction(func(L *lua.LState) int {
+		v, err := luaValueToJSON(L.CheckAny(1), 0)
+		if err != nil {
+			L.RaiseError("json encode: %v", err)
+			return 0
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			L.RaiseError("json encode: %v", err)
+			return 0
+		}
+		L.Push(lua.LString(buf))
+		return 1
+	}))
+
+	mod.RawSetString("decode", L.NewFunction(func(L *lua.LState) int {
+		str := L.CheckString(1)
+		var v interface{}
+		if err := json.Unmarshal([]byte(str), &v); err != nil {
+			L.RaiseError("json decode: %v", err)
+			return 0
+		}
+		lv, err := jsonToLuaValue(L, v, 0)
+		if err != nil {
+			L.RaiseError("json decode: %v", err)
+			return 0
+		}
+		L.Push(lv)
+		return 1
+	}))
+
+	L.SetGlobal("json", mod)
+}
+
+// luaValueToJSON converts a lua value into a JSON-marshalable Go value.
+// Lua tables become JSON arrays when they only hold contiguous integer
+// keys 1..n, and JSON objects otherwise; nil becomes JSON null.
+func luaValueToJSON(v lua.LValue, depth int) (interface{}, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("exceeded max encoding depth of %d", maxJSONDepth)
+	}
+
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if n := v.Len(); n > 0 && tableIsArray(v, n) {
+			arr := make([]interface{}, n)
+			for i := 1; i <= n; i++ {
+				elem, err := luaValueToJSON(v.RawGetInt(i), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr[i-1] = elem
+			}
+			return arr, nil
+		}
+
+		obj := make(map[string]interface{})
+		var rangeErr error
+		v.ForEach(func(k, val lua.LValue) {
+			if rangeErr != nil {
+				return
+			}
+			elem, err := luaValueToJSON(val, depth+1)
+			if err != nil {
+				rangeErr = err
+				return
+			}
+			obj[k.String()] = elem
+		})
+		if rangeErr != nil {
+			return nil, rangeErr
+		}
+		return obj, nil
+	default:
+		return nil, fmt.Errorf("cannot encode lua type %s as json", v.Type().String())
+	}
+}
+
+// tableIsArray reports whether t only has the contiguous integer keys
+// 1..n, i.e. whether it should be encoded as a JSON array rather than
+// an object.
+func tableIsArray(t *lua.LTable, n int) bool {
+	count := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { count++ })
+	return count == n
+}
+
+// jsonToLuaValue converts a decoded JSON value (as produced by
+// encoding/json, i.e. only nil/bool/float64/string/[]interface{}/
+// map[string]interface{}) into the equivalent lua value. It errors out
+// rather than truncating a document nested past maxJSONDepth, so callers
+// can tell a malicious/oversized document from a legitimately empty one.
+func jsonToLuaValue(L *lua.LState, v interface{}, depth int) (lua.LValue, error) {
+	if depth > maxJSONDepth {
+		return lua.LNil, fmt.Errorf("exceeded max decoding depth of %d", maxJSONDepth)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil, nil
+	case bool:
+		return lua.LBool(v), nil
+	case float64:
+		return lua.LNumber(v), nil
+	case string:
+		return lua.LString(v), nil
+	case []interface{}:
+		t := L.NewTable()
+		for i, elem := range v {
+			lv, err := jsonToLuaValue(L, elem, depth+1)
+			if err != nil {
+				return lua.LNil, err
+			}
+			t.RawSetInt(i+1, lv)
+		}
+		return t, nil
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, elem := range v {
+			lv, err := jsonToLuaValue(L, elem, depth+1)
+			if err != nil {
+				return lua.LNil, err
+			}
+			t.RawSetString(k, lv)
+		}
+		return t, nil
+	default:
+		return lua.LNil, fmt.Errorf("cannot decode json value of type %T", v)
+	}
+}
+
+// record:getJSON(fidx) table
+func luaRecordGetJSON(L *lua.LState) int {
+	luar := fastcheckLuaRecord(L, 1)
+	fidx := L.CheckInt(2)
+
+	buf := luar.r.Get(baker.FieldIndex(fidx))
+
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		L.RaiseError("getJSON: %v", err)
+		return 0
+	}
+	lv, err := jsonToLuaValue(L, v, 0)
+	if err != nil {
+		L.RaiseError("getJSON: %v", err)
+		return 0
+	}
+	L.Push(lv)
+	return 1
+}
+
+// record:setJSON(fidx, table)
+func luaRecordSetJSON(L *lua.LState) int {
+	luar := fastcheckLuaRecord(L, 1)
+	fidx := L.CheckInt(2)
+	val := L.CheckAny(3)
+
+	v, err := luaValueToJSON(val, 0)
+	if err != nil {
+		L.RaiseError("setJSON: %v", err)
+		return 0
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		L.RaiseError("setJSON: %v", err)
+		return 0
+	}
+
+	luar.r.Set(baker.FieldIndex(fidx), buf)
+	return 0
+}
@@ -0,0 +1,326 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stdin is used to read the top-level manifest when "@-" is given, and
+// is replaced in tests to simulate piped input.
+var stdin io.Reader = os.Stdin
+
+// ListDesc describes the List input.
+var ListDesc = baker.InputDesc{
+	Name:   "List",
+	New:    NewList,
+	Config: &ListConfig{},
+	Help: `Reads records from a static list of files.
+
+Each entry in Files is either a path/URL to a log file, or, when prefixed
+with '@', a manifest: a list of further entries, one per line, read and
+expanded in place (a manifest entry may itself be another manifest).
+Use "@-" to read the top-level manifest from stdin.
+
+Both log files and manifests can be local paths or http(s)/s3 URLs
+(s3://bucket/key). Remote fetches are retried, with exponential backoff,
+on transient errors.`,
+}
+
+// ListConfig holds the configuration for the List input.
+type ListConfig struct {
+	Files   []string      `help:"List of files (or '@'-prefixed manifests) to process. Entries can be local paths or http(s)/s3 URLs" required:"true"`
+	Timeout time.Duration `help:"Timeout of a single http(s)/s3 request issued to fetch a manifest or a remote file" default:"30s"`
+	Retries int           `help:"Number of retries, with exponential backoff, on transient http(s)/s3 errors" default:"3"`
+}
+
+// List is a baker input that reads a static list of (possibly remote)
+// files, expanding '@' manifests along the way.
+type List struct {
+	cfg *ListConfig
+}
+
+// NewList creates a List input.
+func NewList(cfg baker.InputParams) (baker.Input, error) {
+	dcfg := cfg.DecodedConfig.(*ListConfig)
+	return &List{cfg: dcfg}, nil
+}
+
+func (l *List) Stats() baker.InputStats { return baker.InputStats{} }
+
+func (l *List) Stop() {}
+
+// FreeMem is a no-op: List doesn't pool or otherwise reuse the
+// baker.Data it emits, so there's nothing to release here.
+func (l *List) FreeMem(data *baker.Data) {}
+
+// Run resolves every entry in Files (expanding manifests as it goes) and
+// emits one baker.Data per file, in order, aborting on the first error
+// so that a missing/unreachable file fails the whole run.
+func (l *List) Run(output chan<- *baker.Data) error {
+	return l.visitAll(l.cfg.Files, func(path string) error {
+		data, err := l.readFile(path)
+		if err != nil {
+			return fmt.Errorf("list: can't read %q: %v", path, err)
+		}
+		output <- data
+		return nil
+	})
+}
+
+// visitAll walks refs in order, expanding '@' manifests depth-first and
+// calling visit on each resolved file path/URL. It stops and returns the
+// first error encountered, without reading past the offending entry -
+// this lets e.g. an invalid "@-" stdin manifest abort immediately rather
+// than waiting for stdin to be closed.
+func (l *List) visitAll(refs []string, visit func(path string) error) error {
+	for _, ref := range refs {
+		if err := l.visitRef(ref, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *List) visitRef(ref string, visit func(path string) error) error {
+	if !strings.HasPrefix(ref, "@") {
+		return visit(ref)
+	}
+	return l.visitManifest(ref[1:], visit)
+}
+
+func (l *List) visitManifest(manifest string, visit func(path string) error) error {
+	r, closeFn, err := l.openManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("list: can't open manifest %q: %v", manifest, err)
+	}
+	defer closeFn()
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if err := l.visitRef(line, visit); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (l *List) openManifest(ref string) (io.Reader, func(), error) {
+	switch {
+	case ref == "-":
+		return stdin, func() {}, nil
+	case strings.HasPrefix(ref, "http://"), strings.HasPrefix(ref, "https://"):
+		buf, _, err := fetchHTTP(l.cfg, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bytes.NewReader(buf), func() {}, nil
+	case strings.HasPrefix(ref, "s3://"):
+		buf, _, err := fetchS3(l.cfg, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bytes.NewReader(buf), func() {}, nil
+	default:
+		f, err := os.Open(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+}
+
+// readFile fetches path (local, http(s) or s3) and gunzips it if its
+// name ends in ".gz", returning a baker.Data ready to be sent downstream.
+func (l *List) readFile(path string) (*baker.Data, error) {
+	var (
+		buf          []byte
+		lastModified time.Time
+		err          error
+	)
+
+	switch {
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		buf, lastModified, err = fetchHTTP(l.cfg, path)
+	case strings.HasPrefix(path, "s3://"):
+		buf, lastModified, err = fetchS3(l.cfg, path)
+	default:
+		buf, lastModified, err = readLocalFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		if buf, err = gunzip(buf); err != nil {
+			return nil, fmt.Errorf("can't gunzip: %v", err)
+		}
+	}
+
+	return &baker.Data{
+		Bytes: buf,
+		Meta:  map[string]interface{}{"last_modified": lastModified},
+	}, nil
+}
+
+func readLocalFile(path string) ([]byte, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return buf, fi.ModTime(), nil
+}
+
+func gunzip(buf []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// nonRetryableErr marks an error (e.g an HTTP 404 or S3 NoSuchKey) as
+// permanent, so withRetry gives up immediately instead of retrying it.
+type nonRetryableErr struct{ err error }
+
+func (e *nonRetryableErr) Error() string { return e.err.Error() }
+func (e *nonRetryableErr) Unwrap() error { return e.err }
+
+// withRetry calls fn up to retries+1 times, with exponential backoff
+// between attempts, stopping early if fn returns a *nonRetryableErr.
+func withRetry(retries int, fn func() error) error {
+	const initialBackoff = 200 * time.Millisecond
+
+	backoff := initialBackoff
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if _, ok := err.(*nonRetryableErr); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// fetchHTTP GETs rawurl, retrying transient failures (network errors and
+// 5xx responses) with exponential backoff. 4xx responses are treated as
+// permanent failures and are not retried.
+func fetchHTTP(cfg *ListConfig, rawurl string) ([]byte, time.Time, error) {
+	var body []byte
+	var lastModified time.Time
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	err := withRetry(cfg.Retries, func() error {
+		resp, err := client.Get(rawurl)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			err := fmt.Errorf("%s: unexpected status %q", rawurl, resp.Status)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return &nonRetryableErr{err}
+			}
+			return err
+		}
+
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = buf
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			if t, err := http.ParseTime(lm); err == nil {
+				lastModified = t
+			}
+		}
+		return nil
+	})
+	return body, lastModified, err
+}
+
+// fetchS3 downloads bucket/key from rawurl (s3://bucket/key), retrying
+// transient failures with exponential backoff. A missing object is
+// treated as a permanent failure and is not retried.
+func fetchS3(cfg *ListConfig, rawurl string) ([]byte, time.Time, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid s3 url %q: %v", rawurl, err)
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	svc := s3.New(sess)
+
+	var body []byte
+	var lastModified time.Time
+
+	err = withRetry(cfg.Retries, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+
+		out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				return &nonRetryableErr{err}
+			}
+			return err
+		}
+		defer out.Body.Close()
+
+		buf, err := ioutil.ReadAll(out.Body)
+		if err != nil {
+			return err
+		}
+		body = buf
+		if out.LastModified != nil {
+			lastModified = *out.LastModified
+		}
+		return nil
+	})
+	return body, lastModified, err
+}